@@ -0,0 +1,142 @@
+package citadel
+
+import "encoding/json"
+
+const (
+	Running = "running"
+	Stopped = "stopped"
+)
+
+// State represents the runtime status of a container.
+type State struct {
+	Status   string `json:"status,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+// Host is a machine participating in the cluster and is kept in sync
+// with the repository so the manager can schedule work against it.
+type Host struct {
+	ID          string      `json:"id,omitempty"`
+	Addr        string      `json:"addr,omitempty"`
+	Region      string      `json:"region,omitempty"`
+	Cpus        int         `json:"cpus,omitempty"`
+	Memory      int         `json:"memory,omitempty"`
+	Draining    bool        `json:"draining,omitempty"`
+	Utilization Utilization `json:"utilization,omitempty"`
+}
+
+// Utilization is a snapshot of a host's live resource usage, published
+// periodically so the scheduler can place work against actual load
+// instead of just declared capacity.
+type Utilization struct {
+	CpuPercent float64 `json:"cpu_percent,omitempty"`
+	MemoryUsed int     `json:"memory_used,omitempty"`
+	Pids       int     `json:"pids,omitempty"`
+}
+
+// TaskResult records whether a run task was fully, partially, or not
+// accepted by the host it was placed on.
+type TaskResult struct {
+	TaskID   string `json:"task_id,omitempty"`
+	Accepted bool   `json:"accepted,omitempty"`
+	Placed   int    `json:"placed,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Handoff describes a checkpointed container that a draining host has
+// handed off for another host to restore.
+type Handoff struct {
+	ContainerID    string `json:"container_id,omitempty"`
+	Image          string `json:"image,omitempty"`
+	HostID         string `json:"host_id,omitempty"`
+	CheckpointPath string `json:"checkpoint_path,omitempty"`
+	TargetHost     string `json:"target_host,omitempty"`
+
+	// Config is the container's original docker config (marshalled
+	// dockerclient.ContainerConfig), captured at checkpoint time. CRIU
+	// restore needs the exact config the checkpoint was taken against,
+	// not just the image name.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// Container is the citadel view of a container running on a host.
+type Container struct {
+	ID     string `json:"id,omitempty"`
+	Image  string `json:"image,omitempty"`
+	HostID string `json:"host_id,omitempty"`
+	Cpus   int    `json:"cpus,omitempty"`
+	Memory int    `json:"memory,omitempty"`
+	State  State  `json:"state,omitempty"`
+}
+
+// Task is a unit of work queued for a specific host to execute.
+type Task struct {
+	ID          string            `json:"id,omitempty"`
+	Host        string            `json:"host,omitempty"`
+	Command     string            `json:"command,omitempty"`
+	Image       string            `json:"image,omitempty"`
+	ContainerID string            `json:"container_id,omitempty"`
+	Cpus        int               `json:"cpus,omitempty"`
+	Memory      int               `json:"memory,omitempty"`
+	Instances   int               `json:"instances,omitempty"`
+	Exec        *ExecConfig       `json:"exec,omitempty"`
+	Spec        *Spec             `json:"spec,omitempty"`
+	Runtime     string            `json:"runtime,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	RestartPolicy string          `json:"restart_policy,omitempty"`
+	NetworkMode string            `json:"network_mode,omitempty"`
+	SecurityOpt []string          `json:"security_opt,omitempty"`
+}
+
+// Spec is the subset of the OCI runtime spec that citadel understands
+// and translates into the container runtime's own config at task
+// execution time.
+type Spec struct {
+	Process *ProcessSpec `json:"process,omitempty"`
+	Mounts  []Mount      `json:"mounts,omitempty"`
+	Linux   *LinuxSpec   `json:"linux,omitempty"`
+	CapAdd  []string     `json:"cap_add,omitempty"`
+	CapDrop []string     `json:"cap_drop,omitempty"`
+}
+
+type ProcessSpec struct {
+	Args       []string `json:"args,omitempty"`
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	Cwd        string   `json:"cwd,omitempty"`
+	Terminal   bool     `json:"terminal,omitempty"`
+	User       string   `json:"user,omitempty"`
+}
+
+type Mount struct {
+	Source      string   `json:"source,omitempty"`
+	Destination string   `json:"destination,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type LinuxSpec struct {
+	Resources  *Resources  `json:"resources,omitempty"`
+	Namespaces []Namespace `json:"namespaces,omitempty"`
+	Devices    []string    `json:"devices,omitempty"`
+}
+
+type Resources struct {
+	CpuShares int64 `json:"cpu_shares,omitempty"`
+	Memory    int64 `json:"memory,omitempty"`
+}
+
+type Namespace struct {
+	Type string `json:"type,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// ExecConfig describes a one-off command to run inside an already
+// running container, used by the "exec" task command.
+type ExecConfig struct {
+	Cmd     []string `json:"cmd,omitempty"`
+	Tty     bool     `json:"tty,omitempty"`
+	Stdin   bool     `json:"stdin,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	User    string   `json:"user,omitempty"`
+	Workdir string   `json:"workdir,omitempty"`
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,14 +22,69 @@ import (
 )
 
 type (
+	// managedContainer is the host's in-memory handle on a container it
+	// is tracking, used to avoid re-inspecting and re-saving every
+	// container on every docker event.
+	managedContainer struct {
+		id        string
+		info      *dockerclient.ContainerInfo
+		lastState citadel.State
+
+		// cpus/memory are the amounts reserved against the ledger while
+		// this container is running, cached here so a later stop/die/
+		// destroy event can release the same amount without
+		// re-inspecting a container that may already be gone.
+		cpus   int
+		memory int
+	}
+
 	HostEngine struct {
 		client     *dockerclient.DockerClient
 		repository *repository.Repository
 		id         string
 		listenAddr string
+		cpus       int
+		memory     int
+
+		mu         sync.RWMutex
+		containers map[string]*managedContainer
+		ledger     *resourceLedger
+
+		// dispatchMu guards dispatching, the set of task IDs currently
+		// being handled, so the ticker's FetchTasks fallback can't
+		// re-dispatch a task the stream already handed to taskHandler
+		// while it's still in flight.
+		dispatchMu  sync.Mutex
+		dispatching map[string]struct{}
+
+		// statsMu serializes every call into dockerclient's stats monitor.
+		// samalba/dockerclient only exposes a process-global
+		// StopAllMonitorStats, so any two callers racing a start/stop pair
+		// (reconcileUtilization's sampling vs. a live statsHandler stream)
+		// would tear down each other's stream; holding this for the
+		// duration of a sample keeps the client to one monitor at a time.
+		statsMu sync.Mutex
+
+		// drain controls whether a shutdown signal checkpoints and
+		// hands off running containers instead of orphaning them.
+		drain         bool
+		checkpointDir string
+		drainGrace    time.Duration
 	}
 )
 
+// reconcileInterval is how often the host falls back to a full container
+// list to self-heal from any docker events that were dropped.
+const reconcileInterval = 30 * time.Second
+
+// cpuSharesPerCpu converts between the cpu-count unit task.Cpus, the
+// ledger, and a host's declared cpus are expressed in, and docker's
+// CpuShares relative-weight unit (1024 is docker's default share per
+// cpu). The ledger and task.Cpus stay in cpu-count; only the docker
+// config translation and the container-info readback cross into
+// shares.
+const cpuSharesPerCpu = 1024
+
 var hostCommand = cli.Command{
 	Name:   "host",
 	Usage:  "run the host and connect it to the cluster",
@@ -37,17 +97,23 @@ var hostCommand = cli.Command{
 		cli.IntFlag{"cpus", -1, "number of cpus available to the host"},
 		cli.IntFlag{"memory", -1, "number of mb of memory available to the host"},
 		cli.StringFlag{"listen, l", ":8787", "listen address"},
+		cli.BoolFlag{"drain", "checkpoint and hand off running containers on shutdown instead of orphaning them"},
+		cli.StringFlag{"checkpoint-dir", "/var/lib/citadel/checkpoints", "directory to write container checkpoints to when draining"},
+		cli.IntFlag{"drain-grace", 30, "seconds to wait for checkpoints and handoff records to be written before exiting a drain (no ack from the receiving host is awaited)"},
 	},
 }
 
 func hostAction(context *cli.Context) {
 	var (
-		cpus       = context.Int("cpus")
-		memory     = context.Int("memory")
-		addr       = context.String("addr")
-		region     = context.String("region")
-		hostId     = context.String("host-id")
-		listenAddr = context.String("listen")
+		cpus          = context.Int("cpus")
+		memory        = context.Int("memory")
+		addr          = context.String("addr")
+		region        = context.String("region")
+		hostId        = context.String("host-id")
+		listenAddr    = context.String("listen")
+		drain         = context.Bool("drain")
+		checkpointDir = context.String("checkpoint-dir")
+		drainGrace    = context.Int("drain-grace")
 	)
 	if hostId == "" {
 		id, err := utils.GetMachineID()
@@ -90,10 +156,18 @@ func hostAction(context *cli.Context) {
 	}
 
 	hostEngine := &HostEngine{
-		client:     client,
-		repository: r,
-		id:         hostId,
-		listenAddr: listenAddr,
+		client:        client,
+		repository:    r,
+		id:            hostId,
+		listenAddr:    listenAddr,
+		cpus:          cpus,
+		memory:        memory,
+		containers:    make(map[string]*managedContainer),
+		dispatching:   make(map[string]struct{}),
+		ledger:        newResourceLedger(cpus, memory),
+		drain:         drain,
+		checkpointDir: checkpointDir,
+		drainGrace:    time.Duration(drainGrace) * time.Second,
 	}
 	// start
 	go hostEngine.run()
@@ -107,8 +181,11 @@ func (eng *HostEngine) waitForInterrupt() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	for _ = range sigChan {
-		// stop engine
-		eng.stop()
+		if eng.drain {
+			eng.drainAndStop()
+		} else {
+			eng.stop()
+		}
 		os.Exit(0)
 	}
 }
@@ -122,17 +199,235 @@ func (eng *HostEngine) run() {
 	// listen for events
 	eng.client.StartMonitorEvents(eng.dockerEventHandler)
 
-	if err := http.ListenAndServe(eng.listenAddr, nil); err != nil {
+	// periodically self-heal the managed container handles in case a
+	// docker event was dropped and never reached dockerEventHandler
+	go eng.reconcileContainers()
+
+	// sample live resource usage and publish it to the host record so
+	// the scheduler can place work against actual, not just declared, load
+	go eng.reconcileUtilization()
+
+	mux := http.NewServeMux()
+	eng.registerHandlers(mux)
+
+	if err := http.ListenAndServe(eng.listenAddr, mux); err != nil {
 		logger.WithField("error", err).Fatal("unable to listen on http")
 	}
 }
 
+func (eng *HostEngine) reconcileContainers() {
+	for _ = range time.Tick(reconcileInterval) {
+		if err := eng.loadContainers(); err != nil {
+			logger.WithField("error", err).Error("unable to reconcile containers")
+		}
+	}
+}
+
+// reconcileUtilization periodically samples docker stats for every
+// managed container and publishes the aggregate cpu/memory/pids usage
+// onto this host's repository record.
+func (eng *HostEngine) reconcileUtilization() {
+	for _ = range time.Tick(reconcileInterval) {
+		eng.mu.RLock()
+		ids := make([]string, 0, len(eng.containers))
+		for id := range eng.containers {
+			ids = append(ids, id)
+		}
+		eng.mu.RUnlock()
+
+		var cpuPercent float64
+		var memoryUsed, pids int
+
+		for _, id := range ids {
+			stats, err := eng.sampleStats(id)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"id":    id,
+					"error": err,
+				}).Warn("unable to sample container stats")
+				continue
+			}
+
+			cpuPercent += calculateCpuPercent(stats)
+			memoryUsed += int(stats.MemoryStats.Usage / 1024 / 1024)
+			pids += stats.PidsStats.Current
+		}
+
+		u := citadel.Utilization{CpuPercent: cpuPercent, MemoryUsed: memoryUsed, Pids: pids}
+		if err := eng.repository.UpdateHostUtilization(eng.id, u); err != nil {
+			logger.WithField("error", err).Error("unable to publish host utilization")
+		}
+	}
+}
+
+// sampleStats takes a single docker stats reading for a container.
+// StartMonitorStats streams continuously until stopped, so the monitor
+// is always stopped before returning to avoid leaking a stats stream
+// per call. statsMu is held for the duration since StopAllMonitorStats
+// is process-global and would otherwise stop a stream started by a
+// concurrent caller (e.g. statsHandler).
+func (eng *HostEngine) sampleStats(id string) (*dockerclient.Stats, error) {
+	eng.statsMu.Lock()
+	defer eng.statsMu.Unlock()
+
+	statsChan := make(chan *dockerclient.Stats, 1)
+	errChan := make(chan error, 1)
+
+	cb := func(_ string, stats *dockerclient.Stats, err error, args ...interface{}) {
+		if err != nil {
+			select {
+			case errChan <- err:
+			default:
+			}
+			return
+		}
+		select {
+		case statsChan <- stats:
+		default:
+		}
+	}
+
+	go eng.client.StartMonitorStats(id, cb)
+	defer eng.client.StopAllMonitorStats()
+
+	select {
+	case stats := <-statsChan:
+		return stats, nil
+	case err := <-errChan:
+		return nil, err
+	case <-time.After(5 * time.Second):
+		return nil, fmt.Errorf("timed out sampling stats for %s", id)
+	}
+}
+
+func calculateCpuPercent(stats *dockerclient.Stats) float64 {
+	cpuDelta := float64(stats.CpuStats.CpuUsage.TotalUsage - stats.PreCpuStats.CpuUsage.TotalUsage)
+	systemDelta := float64(stats.CpuStats.SystemUsage - stats.PreCpuStats.SystemUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+
+	return (cpuDelta / systemDelta) * float64(len(stats.CpuStats.CpuUsage.PercpuUsage)) * 100
+}
+
 func (eng *HostEngine) stop() {
 	logger.Info("Stopping")
 	// remove host from repository
 	eng.repository.DeleteHost(eng.id)
 }
 
+// drainAndStop marks the host as draining so the scheduler stops
+// placing work on it, checkpoints every running container and hands
+// each off via the repository, then falls through to the normal stop.
+// It waits at most drainGrace for the handoffs to be written before
+// giving up and exiting anyway.
+func (eng *HostEngine) drainAndStop() {
+	logger.Info("draining")
+
+	if err := eng.repository.MarkHostDraining(eng.id); err != nil {
+		logger.WithField("error", err).Error("unable to mark host draining")
+	}
+
+	eng.mu.RLock()
+	containers := make([]*managedContainer, 0, len(eng.containers))
+	for _, c := range eng.containers {
+		if c.lastState.Status == citadel.Running {
+			containers = append(containers, c)
+		}
+	}
+	eng.mu.RUnlock()
+
+	targetHost := eng.pickHandoffTarget()
+
+	var wg sync.WaitGroup
+	for _, c := range containers {
+		wg.Add(1)
+		go func(c *managedContainer) {
+			defer wg.Done()
+			eng.checkpointAndHandoff(c, targetHost)
+		}(c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(eng.drainGrace):
+		logger.Warn("drain grace period expired before all handoffs completed")
+	}
+
+	eng.stop()
+}
+
+// pickHandoffTarget returns the id of another non-draining host to hint
+// as the destination for this host's checkpointed containers, or "" if
+// none is available.
+func (eng *HostEngine) pickHandoffTarget() string {
+	hosts, err := eng.repository.FetchHosts()
+	if err != nil {
+		logger.WithField("error", err).Warn("unable to list hosts for handoff target hint")
+		return ""
+	}
+
+	for _, h := range hosts {
+		if h.ID != eng.id && !h.Draining {
+			return h.ID
+		}
+	}
+	return ""
+}
+
+// checkpointAndHandoff checkpoints a single container via CRIU and
+// records a Handoff so another host can restore it. The full original
+// ContainerConfig is captured, not just the image name, since CRIU
+// restore requires recreating the container exactly as it was
+// checkpointed (cmd, env, mounts, and so on).
+func (eng *HostEngine) checkpointAndHandoff(c *managedContainer, targetHost string) {
+	cmd := exec.Command("docker", "checkpoint", "create", "--checkpoint-dir", eng.checkpointDir, c.id, c.id)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"id":     c.id,
+			"error":  err,
+			"output": string(out),
+		}).Error("unable to checkpoint container")
+		return
+	}
+
+	configData, err := json.Marshal(c.info.Config)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"id":    c.id,
+			"error": err,
+		}).Error("unable to marshal container config for handoff")
+		return
+	}
+
+	handoff := &citadel.Handoff{
+		ContainerID:    c.id,
+		Image:          c.info.Config.Image,
+		HostID:         eng.id,
+		CheckpointPath: eng.checkpointDir,
+		TargetHost:     targetHost,
+		Config:         configData,
+	}
+
+	if err := eng.repository.SaveHandoff(handoff); err != nil {
+		logger.WithFields(logrus.Fields{
+			"id":    c.id,
+			"error": err,
+		}).Error("unable to save handoff record")
+	}
+}
+
+// loadContainers does a full list+inspect of every container on the
+// host and rebuilds both the repository and in-memory managed container
+// map from scratch. It is O(N) RPCs, so it is only used at startup and
+// from the periodic reconciliation pass; per-event updates go through
+// updateManagedContainer instead.
 func (eng *HostEngine) loadContainers() error {
 	eng.repository.DeleteHostContainers(eng.id)
 
@@ -141,30 +436,51 @@ func (eng *HostEngine) loadContainers() error {
 		return err
 	}
 
+	managed := make(map[string]*managedContainer)
+	var reservedCpus, reservedMemory int
+
 	for _, c := range containers {
-		cc, err := eng.generateContainerInfo(c)
+		info, err := eng.client.InspectContainer(c.Id)
 		if err != nil {
 			return err
 		}
+
+		cc := eng.containerFromInfo(info)
 		if err := eng.repository.SaveContainer(cc); err != nil {
 			return err
 		}
+
+		managed[info.Id] = &managedContainer{
+			id:        info.Id,
+			info:      info,
+			lastState: cc.State,
+			cpus:      cc.Cpus,
+			memory:    cc.Memory,
+		}
+
+		if cc.State.Status == citadel.Running {
+			reservedCpus += cc.Cpus
+			reservedMemory += cc.Memory
+		}
 	}
 
+	eng.mu.Lock()
+	eng.containers = managed
+	eng.mu.Unlock()
+
+	// reseed the ledger from what's actually running so it self-heals
+	// from any drift caused by a missed docker event
+	eng.ledger.seed(reservedCpus, reservedMemory)
+
 	return nil
 }
 
-func (eng *HostEngine) generateContainerInfo(cnt interface{}) (*citadel.Container, error) {
-	c := cnt.(dockerclient.Container)
-	info, err := eng.client.InspectContainer(c.Id)
-	if err != nil {
-		return nil, err
-	}
+func (eng *HostEngine) containerFromInfo(info *dockerclient.ContainerInfo) *citadel.Container {
 	cc := &citadel.Container{
 		ID:     info.Id,
-		Image:  utils.CleanImageName(c.Image),
+		Image:  utils.CleanImageName(info.Config.Image),
 		HostID: eng.id,
-		Cpus:   info.Config.CpuShares, // FIXME: not the right place, this is cpuset
+		Cpus:   info.Config.CpuShares / cpuSharesPerCpu,
 	}
 
 	if info.Config.Memory > 0 {
@@ -177,43 +493,136 @@ func (eng *HostEngine) generateContainerInfo(cnt interface{}) (*citadel.Containe
 		cc.State.Status = citadel.Stopped
 	}
 	cc.State.ExitCode = info.State.ExitCode
-	return cc, nil
+	return cc
+}
+
+// updateManagedContainer inspects a single container, diffs it against
+// the handle we already hold, and only persists to the repository when
+// something actually changed. This keeps per-event work O(1) instead of
+// the O(N) full reload loadContainers does. It also releases the
+// container's ledger reservation the moment it leaves the running
+// state, instead of waiting on the next loadContainers reconcile, so a
+// churning host doesn't accumulate stale reservations.
+func (eng *HostEngine) updateManagedContainer(id string) error {
+	info, err := eng.client.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+
+	cc := eng.containerFromInfo(info)
+
+	eng.mu.Lock()
+	existing, ok := eng.containers[id]
+	changed := !ok || existing.lastState != cc.State
+	wasRunning := ok && existing.lastState.Status == citadel.Running
+	eng.containers[id] = &managedContainer{
+		id:        id,
+		info:      info,
+		lastState: cc.State,
+		cpus:      cc.Cpus,
+		memory:    cc.Memory,
+	}
+	eng.mu.Unlock()
+
+	if wasRunning && cc.State.Status != citadel.Running {
+		eng.ledger.release(existing.cpus, existing.memory)
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return eng.repository.SaveContainer(cc)
+}
+
+// removeManagedContainer releases the container's ledger reservation if
+// it was still running (docker can send "destroy" without a preceding
+// "die"), then drops it from both the in-memory map and the repository.
+func (eng *HostEngine) removeManagedContainer(id string) error {
+	eng.mu.Lock()
+	existing, ok := eng.containers[id]
+	delete(eng.containers, id)
+	eng.mu.Unlock()
+
+	if ok && existing.lastState.Status == citadel.Running {
+		eng.ledger.release(existing.cpus, existing.memory)
+	}
+
+	return eng.repository.DeleteContainer(eng.id, id)
 }
 
 func (eng *HostEngine) dockerEventHandler(event *dockerclient.Event, args ...interface{}) {
 	switch event.Status {
 	case "destroy":
-		// remove container from repository
-		if err := eng.repository.DeleteContainer(eng.id, event.Id); err != nil {
+		if err := eng.removeManagedContainer(event.Id); err != nil {
 			logger.Warnf("Unable to remove container from repository: %s", err)
 		}
 	default:
-		// reload containers into repository
-		// when adding a single container, the Container struct is not
-		// returned but instead ContainerInfo.  to keep the same
-		// generateContainerInfo for a citadel container, i simply
-		// re-run the loadContainers.  this can probably be improved.
-		eng.loadContainers()
+		if err := eng.updateManagedContainer(event.Id); err != nil {
+			logger.WithFields(logrus.Fields{
+				"id":    event.Id,
+				"error": err,
+			}).Error("unable to update managed container")
+		}
 	}
 }
 
+// watch subscribes to task creation events for this host via a
+// long-lived etcd watch, so new work is picked up in roughly one RTT
+// instead of waiting on the next poll. The ticker is kept only as a
+// reconciliation fallback that re-fetches the full task list in case
+// the watch dropped a revision. Both paths dispatch through
+// dispatchTask so a task already in flight from one path can't be
+// re-dispatched by the other before its handler has deleted it.
 func (eng *HostEngine) watch() {
+	taskChan := make(chan *citadel.Task)
+	go eng.repository.TaskStream(eng.id, taskChan)
+
 	tickerChan := time.NewTicker(time.Millisecond * 2000).C
-	for _ = range tickerChan {
-		tasks, err := eng.repository.FetchTasks()
-		if err != nil {
-			logger.Fatal("unable to fetch queue: %s", err)
-		}
 
-		for _, task := range tasks {
-			// filter this hosts tasks
-			if task.Host == eng.id {
-				go eng.taskHandler(task)
+	for {
+		select {
+		case task := <-taskChan:
+			go eng.dispatchTask(task)
+		case <-tickerChan:
+			tasks, err := eng.repository.FetchTasks()
+			if err != nil {
+				logger.WithField("error", err).Error("unable to fetch queue")
+				continue
+			}
+
+			for _, task := range tasks {
+				// filter this hosts tasks
+				if task.Host == eng.id {
+					go eng.dispatchTask(task)
+				}
 			}
 		}
 	}
 }
 
+// dispatchTask hands a task to taskHandler unless that task ID is
+// already in flight, so the ticker's reconciliation fallback can't
+// double-dispatch a task the stream has already handed off but not yet
+// finished (and deleted).
+func (eng *HostEngine) dispatchTask(task *citadel.Task) {
+	eng.dispatchMu.Lock()
+	if _, inFlight := eng.dispatching[task.ID]; inFlight {
+		eng.dispatchMu.Unlock()
+		return
+	}
+	eng.dispatching[task.ID] = struct{}{}
+	eng.dispatchMu.Unlock()
+
+	defer func() {
+		eng.dispatchMu.Lock()
+		delete(eng.dispatching, task.ID)
+		eng.dispatchMu.Unlock()
+	}()
+
+	eng.taskHandler(task)
+}
+
 func (eng *HostEngine) taskHandler(task *citadel.Task) {
 	switch task.Command {
 	case "run":
@@ -240,6 +649,34 @@ func (eng *HostEngine) taskHandler(task *citadel.Task) {
 		}).Info("processing destroy task")
 
 		eng.destroyHandler(task)
+	case "pause":
+		logger.WithFields(logrus.Fields{
+			"host": task.Host,
+		}).Info("processing pause task")
+
+		eng.pauseHandler(task)
+	case "unpause":
+		logger.WithFields(logrus.Fields{
+			"host": task.Host,
+		}).Info("processing unpause task")
+
+		eng.unpauseHandler(task)
+	case "restore":
+		logger.WithFields(logrus.Fields{
+			"host": task.Host,
+		}).Info("processing restore task")
+
+		eng.restoreHandler(task)
+	case "exec", "attach", "logs", "stats":
+		// these are served live over eng.listenAddr so the caller can
+		// hold a hijacked connection or stream; the task is only used
+		// to let the manager enumerate the request, so just clear it
+		logger.WithFields(logrus.Fields{
+			"host":    task.Host,
+			"command": task.Command,
+		}).Info("serving via http endpoint")
+
+		eng.repository.DeleteTask(task.Host, task.ID)
 	default:
 		logger.WithFields(logrus.Fields{
 			"command": task.Command,
@@ -256,36 +693,148 @@ func (eng *HostEngine) runHandler(task *citadel.Task) {
 		"instances": task.Instances,
 	}).Info("running container")
 
-	eng.repository.DeleteTask(task.ID)
+	eng.repository.DeleteTask(task.Host, task.ID)
+
+	result := &citadel.TaskResult{TaskID: task.ID, Accepted: true}
 
 	for i := 0; i < task.Instances; i++ {
-		containerConfig := &dockerclient.ContainerConfig{
-			Image:     task.Image,
-			Memory:    task.Memory * 1024 * 1024,
-			CpuShares: task.Cpus,
+		if !eng.ledger.reserve(task.Cpus, task.Memory) {
+			logger.WithFields(logrus.Fields{
+				"host": task.Host,
+			}).Warn("rejecting instance, host is over capacity")
+
+			result.Reason = "insufficient capacity on host"
+			if result.Placed == 0 {
+				result.Accepted = false
+			}
+			break
 		}
 
+		containerConfig, hostConfig := eng.buildContainerConfig(task)
+
 		containerId, err := eng.client.CreateContainer(containerConfig, "")
 		if err != nil {
+			eng.ledger.release(task.Cpus, task.Memory)
 			logger.WithFields(logrus.Fields{
 				"err": err,
 			}).Error("error creating container")
-			return
+			result.Reason = err.Error()
+			break
 		}
 
-		if err := eng.client.StartContainer(containerId, nil); err != nil {
+		if err := eng.client.StartContainer(containerId, hostConfig); err != nil {
+			eng.ledger.release(task.Cpus, task.Memory)
 			logger.WithFields(logrus.Fields{
 				"err": err,
 			}).Error("error starting container")
-			return
+			result.Reason = err.Error()
+			break
 		}
 
+		result.Placed++
+
 		logger.WithFields(logrus.Fields{
 			"host":  task.Host,
 			"id":    containerId,
 			"image": task.Image,
 		}).Info("started container")
 	}
+
+	if err := eng.repository.SaveTaskResult(result); err != nil {
+		logger.WithField("error", err).Error("unable to save task result")
+	}
+}
+
+// buildContainerConfig translates a task's flat fields and its OCI spec
+// passthrough into docker's own container and host config, so run tasks
+// can carry mounts, env, cap add/drop, devices and a chosen runtime
+// instead of just image/memory/cpu shares. Spec.Linux.Namespaces is not
+// translated; the container gets docker's default namespaces.
+func (eng *HostEngine) buildContainerConfig(task *citadel.Task) (*dockerclient.ContainerConfig, *dockerclient.HostConfig) {
+	containerConfig := &dockerclient.ContainerConfig{
+		Image:     task.Image,
+		Memory:    task.Memory * 1024 * 1024,
+		CpuShares: task.Cpus * cpuSharesPerCpu,
+		Labels:    task.Labels,
+	}
+
+	// Runtime requires a dockerclient/docker version with runtime
+	// selection support (the same generation that added checkpoint
+	// support, which drain/restore already depend on).
+	hostConfig := &dockerclient.HostConfig{
+		Runtime:       task.Runtime,
+		NetworkMode:   task.NetworkMode,
+		SecurityOpt:   task.SecurityOpt,
+		RestartPolicy: dockerclient.RestartPolicy{Name: task.RestartPolicy},
+	}
+
+	spec := task.Spec
+	if spec == nil {
+		return containerConfig, hostConfig
+	}
+
+	if p := spec.Process; p != nil {
+		if len(p.Args) > 0 {
+			containerConfig.Cmd = p.Args
+		}
+		if len(p.Entrypoint) > 0 {
+			containerConfig.Entrypoint = p.Entrypoint
+		}
+		containerConfig.Env = p.Env
+		containerConfig.WorkingDir = p.Cwd
+		containerConfig.Tty = p.Terminal
+		containerConfig.User = p.User
+	}
+
+	for _, m := range spec.Mounts {
+		bind := m.Source + ":" + m.Destination
+		if len(m.Options) > 0 {
+			bind += ":" + strings.Join(m.Options, ",")
+		}
+		hostConfig.Binds = append(hostConfig.Binds, bind)
+	}
+
+	if l := spec.Linux; l != nil {
+		if l.Resources != nil {
+			if l.Resources.CpuShares > 0 {
+				containerConfig.CpuShares = int(l.Resources.CpuShares)
+			}
+			if l.Resources.Memory > 0 {
+				containerConfig.Memory = int(l.Resources.Memory)
+			}
+		}
+
+		for _, d := range l.Devices {
+			hostConfig.Devices = append(hostConfig.Devices, parseDevice(d))
+		}
+	}
+
+	hostConfig.CapAdd = spec.CapAdd
+	hostConfig.CapDrop = spec.CapDrop
+
+	return containerConfig, hostConfig
+}
+
+// parseDevice turns a docker-run style device string
+// (hostPath[:containerPath[:cgroupPermissions]]) into the mapping
+// dockerclient.HostConfig.Devices actually expects.
+func parseDevice(spec string) dockerclient.DeviceMapping {
+	parts := strings.SplitN(spec, ":", 3)
+
+	d := dockerclient.DeviceMapping{
+		PathOnHost:        parts[0],
+		PathInContainer:   parts[0],
+		CgroupPermissions: "rwm",
+	}
+
+	if len(parts) > 1 {
+		d.PathInContainer = parts[1]
+	}
+	if len(parts) > 2 {
+		d.CgroupPermissions = parts[2]
+	}
+
+	return d
 }
 
 func (eng *HostEngine) stopHandler(task *citadel.Task) {
@@ -294,7 +843,7 @@ func (eng *HostEngine) stopHandler(task *citadel.Task) {
 		"id":   task.ContainerID,
 	}).Info("stopping container")
 
-	defer eng.repository.DeleteTask(task.ID)
+	defer eng.repository.DeleteTask(task.Host, task.ID)
 
 	containerId := task.ContainerID
 	if err := eng.client.StopContainer(containerId, 10); err != nil {
@@ -311,7 +860,7 @@ func (eng *HostEngine) restartHandler(task *citadel.Task) {
 		"id":   task.ContainerID,
 	}).Info("restarting container")
 
-	defer eng.repository.DeleteTask(task.ID)
+	defer eng.repository.DeleteTask(task.Host, task.ID)
 
 	containerId := task.ContainerID
 	if err := eng.client.RestartContainer(containerId, 10); err != nil {
@@ -328,7 +877,7 @@ func (eng *HostEngine) destroyHandler(task *citadel.Task) {
 		"id":   task.ContainerID,
 	}).Info("destroying container")
 
-	defer eng.repository.DeleteTask(task.ID)
+	defer eng.repository.DeleteTask(task.Host, task.ID)
 
 	containerId := task.ContainerID
 	if err := eng.client.KillContainer(containerId); err != nil {
@@ -346,3 +895,298 @@ func (eng *HostEngine) destroyHandler(task *citadel.Task) {
 		}).Error("error removing container")
 	}
 }
+
+func (eng *HostEngine) pauseHandler(task *citadel.Task) {
+	logger.WithFields(logrus.Fields{
+		"host": task.Host,
+		"id":   task.ContainerID,
+	}).Info("pausing container")
+
+	defer eng.repository.DeleteTask(task.Host, task.ID)
+
+	if err := eng.client.PauseContainer(task.ContainerID); err != nil {
+		logger.WithFields(logrus.Fields{
+			"containerId": task.ContainerID,
+			"err":         err,
+		}).Error("error pausing container")
+	}
+}
+
+func (eng *HostEngine) unpauseHandler(task *citadel.Task) {
+	logger.WithFields(logrus.Fields{
+		"host": task.Host,
+		"id":   task.ContainerID,
+	}).Info("unpausing container")
+
+	defer eng.repository.DeleteTask(task.Host, task.ID)
+
+	if err := eng.client.UnpauseContainer(task.ContainerID); err != nil {
+		logger.WithFields(logrus.Fields{
+			"containerId": task.ContainerID,
+			"err":         err,
+		}).Error("error unpausing container")
+	}
+}
+
+// restoreHandler starts a container on this host from another host's
+// checkpointed handoff, identified by task.ContainerID.
+func (eng *HostEngine) restoreHandler(task *citadel.Task) {
+	logger.WithFields(logrus.Fields{
+		"host": task.Host,
+		"id":   task.ContainerID,
+	}).Info("restoring container from checkpoint")
+
+	defer eng.repository.DeleteTask(task.Host, task.ID)
+
+	handoff, err := eng.repository.FetchHandoff(task.ContainerID)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"id":    task.ContainerID,
+			"error": err,
+		}).Error("unable to fetch handoff record")
+		return
+	}
+
+	if handoff.TargetHost != "" && handoff.TargetHost != eng.id {
+		logger.WithFields(logrus.Fields{
+			"id":          handoff.ContainerID,
+			"target_host": handoff.TargetHost,
+			"host":        eng.id,
+		}).Warn("restoring handoff on a host other than its target hint")
+	}
+
+	containerConfig := &dockerclient.ContainerConfig{Image: handoff.Image}
+	if len(handoff.Config) > 0 {
+		if err := json.Unmarshal(handoff.Config, containerConfig); err != nil {
+			logger.WithFields(logrus.Fields{
+				"id":    handoff.ContainerID,
+				"error": err,
+			}).Error("unable to unmarshal handoff config, falling back to bare image")
+		}
+	}
+
+	containerId, err := eng.client.CreateContainer(containerConfig, handoff.ContainerID)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"id":    handoff.ContainerID,
+			"error": err,
+		}).Error("error creating container for restore")
+		return
+	}
+
+	cmd := exec.Command("docker", "start", "--checkpoint-dir", handoff.CheckpointPath, "--checkpoint", handoff.ContainerID, containerId)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"id":     containerId,
+			"error":  err,
+			"output": string(out),
+		}).Error("error starting container from checkpoint")
+		return
+	}
+
+	if err := eng.repository.DeleteHandoff(handoff.ContainerID); err != nil {
+		logger.WithFields(logrus.Fields{
+			"id":    handoff.ContainerID,
+			"error": err,
+		}).Warn("unable to clean up handoff record")
+	}
+}
+
+// registerHandlers wires up the host's HTTP endpoint, used for
+// operations that need a live connection to the container (exec,
+// attach) or a long-lived stream (logs, stats) rather than going
+// through the etcd task queue.
+func (eng *HostEngine) registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/containers/", eng.containersHandler)
+}
+
+func (eng *HostEngine) containersHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	containerId, action := parts[1], parts[2]
+
+	switch action {
+	case "exec":
+		eng.execHandler(w, r, containerId)
+	case "attach":
+		eng.attachHandler(w, r, containerId)
+	case "logs":
+		eng.logsHandler(w, r, containerId)
+	case "stats":
+		eng.statsHandler(w, r, containerId)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// execHandler creates and starts a docker exec instance and proxies the
+// hijacked client connection's stdio onto it.
+func (eng *HostEngine) execHandler(w http.ResponseWriter, r *http.Request, containerId string) {
+	var cfg citadel.ExecConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	execConfig := &dockerclient.ExecConfig{
+		Container:    containerId,
+		Cmd:          cfg.Cmd,
+		AttachStdin:  cfg.Stdin,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          cfg.Tty,
+		User:         cfg.User,
+	}
+
+	execId, err := eng.client.ExecCreate(execConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := eng.repository.SaveExec(eng.id, containerId, execId); err != nil {
+		logger.WithField("error", err).Warn("unable to record exec instance")
+	}
+	defer eng.repository.DeleteExec(eng.id, containerId, execId)
+
+	hijacked, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer hijacked.Close()
+
+	conn, err := eng.client.ExecStart(execId, execConfig)
+	if err != nil {
+		logger.WithField("error", err).Error("error starting exec")
+		return
+	}
+	defer conn.Close()
+
+	go io.Copy(conn, bufrw)
+	io.Copy(bufrw, conn)
+}
+
+// attachHandler proxies the hijacked client connection's stdio onto the
+// container's own process, same as `docker attach`.
+func (eng *HostEngine) attachHandler(w http.ResponseWriter, r *http.Request, containerId string) {
+	hijacked, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer hijacked.Close()
+
+	conn, err := eng.client.ContainerAttach(&dockerclient.AttachOptions{
+		Stream: true,
+		Stdout: true,
+		Stderr: true,
+		Stdin:  true,
+	}, containerId)
+	if err != nil {
+		logger.WithField("error", err).Error("error attaching to container")
+		return
+	}
+	defer conn.Close()
+
+	go io.Copy(conn, bufrw)
+	io.Copy(bufrw, conn)
+}
+
+// logsHandler streams the container's raw log output, flushing each read
+// (up to 4096 bytes) to the client as it arrives, for as long as the
+// client stays connected.
+func (eng *HostEngine) logsHandler(w http.ResponseWriter, r *http.Request, containerId string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	reader, err := eng.client.ContainerLogs(containerId, &dockerclient.LogOptions{
+		Follow:     true,
+		Stdout:     true,
+		Stderr:     true,
+		Timestamps: true,
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("error streaming logs")
+		return
+	}
+	defer reader.Close()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// statsStreamInterval is how often statsHandler takes a fresh sample
+// while a client is streaming stats.
+const statsStreamInterval = 2 * time.Second
+
+// statsHandler streams the container's resource usage as
+// newline-delimited JSON, one line per sample. Samples are taken
+// through sampleStats rather than holding its own StartMonitorStats
+// stream open, since StopAllMonitorStats is process-global and would
+// otherwise stop reconcileUtilization's sampling (and vice versa).
+func (eng *HostEngine) statsHandler(w http.ResponseWriter, r *http.Request, containerId string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	var closeNotify <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closeNotify = notifier.CloseNotify()
+	}
+
+	ticker := time.NewTicker(statsStreamInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closeNotify:
+			return
+		case <-ticker.C:
+			stats, err := eng.sampleStats(containerId)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"id":    containerId,
+					"error": err,
+				}).Warn("unable to sample container stats")
+				continue
+			}
+
+			data, err := json.Marshal(stats)
+			if err != nil {
+				continue
+			}
+
+			if _, err := w.Write(append(data, '\n')); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+
+// resourceLedger tracks cpus and memory (mb) reserved by containers the
+// host has accepted, so runHandler can reject or partially fulfill a run
+// task before it over-commits past what the host advertised to etcd.
+type resourceLedger struct {
+	mu sync.Mutex
+
+	cpuCapacity    int
+	memoryCapacity int
+	reservedCpus   int
+	reservedMemory int
+}
+
+func newResourceLedger(cpus, memory int) *resourceLedger {
+	return &resourceLedger{
+		cpuCapacity:    cpus,
+		memoryCapacity: memory,
+	}
+}
+
+// reserve accounts for cpus/memory if doing so would not exceed the
+// host's declared capacity, returning false otherwise.
+func (l *resourceLedger) reserve(cpus, memory int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.reservedCpus+cpus > l.cpuCapacity || l.reservedMemory+memory > l.memoryCapacity {
+		return false
+	}
+
+	l.reservedCpus += cpus
+	l.reservedMemory += memory
+	return true
+}
+
+func (l *resourceLedger) release(cpus, memory int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reservedCpus -= cpus
+	l.reservedMemory -= memory
+}
+
+// seed replaces the current reservations wholesale, used when
+// reconciling against the actual set of managed containers.
+func (l *resourceLedger) seed(cpus, memory int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reservedCpus = cpus
+	l.reservedMemory = memory
+}
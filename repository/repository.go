@@ -0,0 +1,293 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/citadel/citadel"
+	"github.com/coreos/go-etcd/etcd"
+)
+
+const (
+	hostsPath      = "hosts"
+	tasksPath      = "tasks"
+	containersPath = "containers"
+	execsPath      = "execs"
+	handoffsPath   = "handoffs"
+	resultsPath    = "results"
+)
+
+var logger = logrus.New()
+
+// Repository is the etcd-backed store shared by the manager and every
+// host in the cluster.
+type Repository struct {
+	client *etcd.Client
+	prefix string
+}
+
+func New(machines []string, prefix string) *Repository {
+	return &Repository{
+		client: etcd.NewClient(machines),
+		prefix: prefix,
+	}
+}
+
+func (r *Repository) key(parts ...string) string {
+	return path.Join(append([]string{r.prefix}, parts...)...)
+}
+
+func (r *Repository) SaveHost(host *citadel.Host) error {
+	data, err := json.Marshal(host)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Set(r.key(hostsPath, host.ID), string(data), 0)
+	return err
+}
+
+func (r *Repository) DeleteHost(id string) error {
+	_, err := r.client.Delete(r.key(hostsPath, id), true)
+	return err
+}
+
+// FetchHosts lists every host registered in the cluster, used to pick a
+// handoff target hint when a host drains.
+func (r *Repository) FetchHosts() ([]*citadel.Host, error) {
+	resp, err := r.client.Get(r.key(hostsPath), true, false)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var hosts []*citadel.Host
+	for _, n := range resp.Node.Nodes {
+		var h citadel.Host
+		if err := json.Unmarshal([]byte(n.Value), &h); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, &h)
+	}
+	return hosts, nil
+}
+
+func (r *Repository) FetchHost(id string) (*citadel.Host, error) {
+	resp, err := r.client.Get(r.key(hostsPath, id), false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var host citadel.Host
+	if err := json.Unmarshal([]byte(resp.Node.Value), &host); err != nil {
+		return nil, err
+	}
+	return &host, nil
+}
+
+// MarkHostDraining flags a host as draining in etcd so the scheduler
+// stops placing new work on it while it hands off its containers.
+func (r *Repository) MarkHostDraining(id string) error {
+	host, err := r.FetchHost(id)
+	if err != nil {
+		return err
+	}
+
+	host.Draining = true
+	return r.SaveHost(host)
+}
+
+// UpdateHostUtilization publishes a host's live resource usage so the
+// scheduler can make placement decisions against actual load.
+func (r *Repository) UpdateHostUtilization(id string, u citadel.Utilization) error {
+	host, err := r.FetchHost(id)
+	if err != nil {
+		return err
+	}
+
+	host.Utilization = u
+	return r.SaveHost(host)
+}
+
+// SaveTaskResult records whether a host fully, partially, or did not
+// accept a run task, so the manager can reschedule unplaced instances.
+func (r *Repository) SaveTaskResult(result *citadel.TaskResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Set(r.key(resultsPath, result.TaskID), string(data), 0)
+	return err
+}
+
+// SaveHandoff records a checkpointed container so another host can pick
+// it up with a "restore" task.
+func (r *Repository) SaveHandoff(h *citadel.Handoff) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Set(r.key(handoffsPath, h.ContainerID), string(data), 0)
+	return err
+}
+
+func (r *Repository) FetchHandoff(containerId string) (*citadel.Handoff, error) {
+	resp, err := r.client.Get(r.key(handoffsPath, containerId), false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var h citadel.Handoff
+	if err := json.Unmarshal([]byte(resp.Node.Value), &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (r *Repository) DeleteHandoff(containerId string) error {
+	_, err := r.client.Delete(r.key(handoffsPath, containerId), false)
+	return err
+}
+
+func (r *Repository) DeleteHostContainers(hostId string) error {
+	_, err := r.client.Delete(r.key(containersPath, hostId), true)
+	return err
+}
+
+func (r *Repository) SaveContainer(c *citadel.Container) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Set(r.key(containersPath, c.HostID, c.ID), string(data), 0)
+	return err
+}
+
+func (r *Repository) DeleteContainer(hostId, id string) error {
+	_, err := r.client.Delete(r.key(containersPath, hostId, id), false)
+	return err
+}
+
+// SaveTask validates task before queuing it for its host, so a bad
+// runtime spec fails at submission time instead of on the host.
+func (r *Repository) SaveTask(task *citadel.Task) error {
+	if err := validateSpec(task.Spec); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Set(r.key(tasksPath, task.Host, task.ID), string(data), 0)
+	return err
+}
+
+func validateSpec(spec *citadel.Spec) error {
+	if spec == nil {
+		return nil
+	}
+
+	for _, m := range spec.Mounts {
+		if m.Source == "" || m.Destination == "" {
+			return fmt.Errorf("mount requires both source and destination: %+v", m)
+		}
+	}
+
+	if spec.Linux != nil {
+		for _, ns := range spec.Linux.Namespaces {
+			if ns.Type == "" {
+				return fmt.Errorf("namespace requires a type")
+			}
+		}
+	}
+
+	return nil
+}
+
+// FetchTasks lists every queued task across all hosts. Tasks are stored
+// one directory per host (tasks/<host>/<id>), so the immediate children
+// of the tasks key are host directories, not task nodes themselves.
+func (r *Repository) FetchTasks() ([]*citadel.Task, error) {
+	resp, err := r.client.Get(r.key(tasksPath), true, true)
+	if err != nil {
+		if isKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var tasks []*citadel.Task
+	for _, hostNode := range resp.Node.Nodes {
+		for _, n := range hostNode.Nodes {
+			var t citadel.Task
+			if err := json.Unmarshal([]byte(n.Value), &t); err != nil {
+				return nil, err
+			}
+			tasks = append(tasks, &t)
+		}
+	}
+	return tasks, nil
+}
+
+func (r *Repository) DeleteTask(hostId, id string) error {
+	_, err := r.client.Delete(r.key(tasksPath, hostId, id), false)
+	return err
+}
+
+// SaveExec records that an exec instance was created for a container so
+// the manager can enumerate live execs without talking to the host.
+func (r *Repository) SaveExec(hostId, containerId, execId string) error {
+	_, err := r.client.Set(r.key(execsPath, hostId, containerId, execId), execId, 0)
+	return err
+}
+
+func (r *Repository) DeleteExec(hostId, containerId, execId string) error {
+	_, err := r.client.Delete(r.key(execsPath, hostId, containerId, execId), false)
+	return err
+}
+
+// TaskStream watches the etcd prefix for a single host's tasks and
+// delivers each created task on taskChan. It runs until the process
+// exits, reconnecting the underlying watch on error, and is meant to be
+// paired with a periodic call to FetchTasks so missed revisions are
+// still picked up.
+func (r *Repository) TaskStream(hostId string, taskChan chan *citadel.Task) {
+	var index uint64
+
+	for {
+		resp, err := r.client.Watch(r.key(tasksPath, hostId), index, true, nil, nil)
+		if err != nil {
+			logger.WithField("error", err).Error("error watching tasks")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		index = resp.Node.ModifiedIndex + 1
+
+		switch resp.Action {
+		case "set", "update", "create":
+		default:
+			continue
+		}
+
+		var task citadel.Task
+		if err := json.Unmarshal([]byte(resp.Node.Value), &task); err != nil {
+			logger.WithField("error", err).Error("error unmarshalling task")
+			continue
+		}
+
+		taskChan <- &task
+	}
+}
+
+func isKeyNotFound(err error) bool {
+	if e, ok := err.(*etcd.EtcdError); ok {
+		return e.ErrorCode == 100
+	}
+	return false
+}
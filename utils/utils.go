@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// GetMachineID returns a stable identifier for the local machine, used
+// as the default host id when one is not specified on the command line.
+func GetMachineID() (string, error) {
+	data, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// CleanImageName strips the tag from a docker image reference, e.g.
+// "redis:latest" becomes "redis".
+func CleanImageName(name string) string {
+	if i := strings.LastIndex(name, ":"); i > 0 && !strings.Contains(name[i:], "/") {
+		return name[:i]
+	}
+	return name
+}